@@ -0,0 +1,182 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cacheKey identifies a cached answer by the client-visible question.
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+func cacheKeyFor(q dns.Question) cacheKey {
+	return cacheKey{name: q.Name, qtype: q.Qtype, qclass: q.Qclass}
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg // pristine answer as received from upstream
+	ttl     uint32   // seconds, as computed at insert time
+	stored  time.Time
+	element *list.Element
+}
+
+// Cache is an LRU cache of DNS responses keyed by (qname, qtype, qclass),
+// honoring the minimum TTL of the answer (or, for negative responses,
+// the SOA MINIMUM per RFC 2308) and decrementing TTLs on every hit so
+// clients see accurate remaining lifetimes.
+type Cache struct {
+	maxSize int
+	maxTTL  time.Duration
+
+	mu    sync.Mutex
+	items map[cacheKey]*cacheEntry
+	lru   *list.List // front = most recently used
+
+	hits   uint64
+	misses uint64
+}
+
+func newCache(maxSize int, maxTTL time.Duration) *Cache {
+	return &Cache{
+		maxSize: maxSize,
+		maxTTL:  maxTTL,
+		items:   make(map[cacheKey]*cacheEntry),
+		lru:     list.New(),
+	}
+}
+
+// get returns a copy of the cached response for q with TTLs decremented
+// to reflect time spent in the cache, or ok=false on a miss or expiry.
+func (c *Cache) get(q dns.Question) (resp *dns.Msg, ok bool) {
+	key := cacheKeyFor(q)
+
+	c.mu.Lock()
+	entry, found := c.items[key]
+	if !found {
+		c.mu.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	elapsed := uint32(time.Since(entry.stored) / time.Second)
+	if elapsed >= entry.ttl {
+		c.removeLocked(entry)
+		c.mu.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	c.lru.MoveToFront(entry.element)
+	msg := entry.msg.Copy()
+	remaining := entry.ttl - elapsed
+	c.mu.Unlock()
+
+	atomic.AddUint64(&c.hits, 1)
+	setTTLs(msg, remaining)
+	return msg, true
+}
+
+// set stores resp for q, evicting the least recently used entry if the
+// cache is full. A zero or negative TTL (e.g. an uncacheable response)
+// is a no-op.
+func (c *Cache) set(q dns.Question, resp *dns.Msg) {
+	ttl := answerTTL(resp)
+	if ttl == 0 {
+		return
+	}
+	if max := uint32(c.maxTTL / time.Second); c.maxTTL > 0 && ttl > max {
+		ttl = max
+	}
+
+	key := cacheKeyFor(q)
+	entry := &cacheEntry{key: key, msg: resp.Copy(), ttl: ttl, stored: time.Now()}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, found := c.items[key]; found {
+		c.removeLocked(old)
+	}
+	entry.element = c.lru.PushFront(entry)
+	c.items[key] = entry
+	for c.maxSize > 0 && len(c.items) > c.maxSize {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			break
+		}
+		c.removeLocked(oldest.Value.(*cacheEntry))
+	}
+}
+
+// removeLocked must be called with c.mu held.
+func (c *Cache) removeLocked(entry *cacheEntry) {
+	c.lru.Remove(entry.element)
+	delete(c.items, entry.key)
+}
+
+// stats returns the running hit/miss counters, for the /metrics hook.
+func (c *Cache) stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+// answerTTL returns the TTL this response should be cached for: the
+// minimum TTL across the answer section for a positive response, or the
+// SOA MINIMUM for a negative one (RFC 2308 NXDOMAIN/NODATA). It returns
+// 0 for responses that should not be cached at all.
+func answerTTL(resp *dns.Msg) uint32 {
+	if resp == nil || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return 0
+	}
+	if resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0 {
+		min := resp.Answer[0].Header().Ttl
+		for _, rr := range resp.Answer[1:] {
+			if ttl := rr.Header().Ttl; ttl < min {
+				min = ttl
+			}
+		}
+		return min
+	}
+	// NXDOMAIN, or NOERROR with no answers (NODATA): negative-cache off
+	// the SOA MINIMUM in the authority section, if present.
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Minttl
+		}
+	}
+	return 0
+}
+
+// setTTLs rewrites every record's TTL to ttl, used to hand out a cache
+// hit with its remaining lifetime rather than the value stored at insert
+// time.
+func setTTLs(msg *dns.Msg, ttl uint32) {
+	for _, rr := range msg.Answer {
+		rr.Header().Ttl = ttl
+	}
+	for _, rr := range msg.Ns {
+		rr.Header().Ttl = ttl
+	}
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			rr.Header().Ttl = ttl
+		}
+	}
+}
+
+// cacheable reports whether req is eligible for caching: transfers are
+// never cached, and DNSSEC-aware clients (DO bit set) bypass the cache
+// unless DNSSEC-aware caching has been enabled.
+func cacheable(req *dns.Msg) bool {
+	if isTransfer(req) {
+		return false
+	}
+	if opt := req.IsEdns0(); opt != nil && opt.Do() && !*cacheDNSSECAware {
+		return false
+	}
+	return true
+}
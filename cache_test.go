@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func nxdomainWithSOA(minttl uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Rcode = dns.RcodeNameError
+	m.Ns = append(m.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns1.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: minttl,
+	})
+	return m
+}
+
+func positiveAnswer(ttl uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+	})
+	return m
+}
+
+func TestAnswerTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		resp *dns.Msg
+		want uint32
+	}{
+		{"nil response", nil, 0},
+		{"positive answer uses minimum record TTL", positiveAnswer(300), 300},
+		{"servfail is not cacheable", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.Rcode = dns.RcodeServerFailure
+			return m
+		}(), 0},
+		{"nxdomain negative-caches off SOA MINIMUM", nxdomainWithSOA(120), 120},
+		{"nxdomain with no SOA is not cacheable", func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("example.com.", dns.TypeA)
+			m.Rcode = dns.RcodeNameError
+			return m
+		}(), 0},
+		{"nodata (noerror, no answers) negative-caches off SOA MINIMUM", func() *dns.Msg {
+			m := nxdomainWithSOA(60)
+			m.Rcode = dns.RcodeSuccess
+			return m
+		}(), 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := answerTTL(tt.resp); got != tt.want {
+				t.Errorf("answerTTL() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheGetSetNegativeCaching(t *testing.T) {
+	c := newCache(10, 0)
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	if _, ok := c.get(q); ok {
+		t.Fatal("get on empty cache returned ok=true")
+	}
+
+	c.set(q, nxdomainWithSOA(120))
+	resp, ok := c.get(q)
+	if !ok {
+		t.Fatal("expected NXDOMAIN response to be cached off the SOA MINIMUM")
+	}
+	if resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("cached rcode = %v, want NXDOMAIN", resp.Rcode)
+	}
+	if len(resp.Ns) != 1 || resp.Ns[0].Header().Ttl != 120 {
+		t.Fatalf("cached SOA TTL = %v, want 120", resp.Ns)
+	}
+}
+
+func TestCacheSetUncacheable(t *testing.T) {
+	c := newCache(10, 0)
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Rcode = dns.RcodeServerFailure
+	c.set(q, m)
+
+	if _, ok := c.get(q); ok {
+		t.Fatal("SERVFAIL response should not have been cached")
+	}
+}
+
+func TestCacheGetDecrementsTTL(t *testing.T) {
+	c := newCache(10, 0)
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	c.set(q, positiveAnswer(300))
+
+	entry := c.items[cacheKeyFor(q)]
+	entry.stored = time.Now().Add(-10 * time.Second)
+
+	resp, ok := c.get(q)
+	if !ok {
+		t.Fatal("expected cache hit")
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 290 {
+		t.Fatalf("TTL after 10s in cache = %d, want 290", ttl)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := newCache(10, 0)
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	c.set(q, positiveAnswer(5))
+
+	entry := c.items[cacheKeyFor(q)]
+	entry.stored = time.Now().Add(-10 * time.Second)
+
+	if _, ok := c.get(q); ok {
+		t.Fatal("expected expired entry to miss")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// UpstreamConfig is one server in a weighted upstream pool.
+type UpstreamConfig struct {
+	Address string `yaml:"address" json:"address"`
+	Weight  int    `yaml:"weight,omitempty" json:"weight,omitempty"`
+}
+
+// RouteConfig routes queries under Suffix to one of Upstreams.
+type RouteConfig struct {
+	Suffix    string           `yaml:"suffix" json:"suffix"`
+	Upstreams []UpstreamConfig `yaml:"upstreams" json:"upstreams"`
+	// Transport forces the wire transport used for Upstreams entries
+	// that don't already name one via a tls://, https:// or quic://
+	// scheme: "udp" or "tcp". Left empty, plain upstreams are queried
+	// over whichever transport the client used to reach us.
+	Transport string        `yaml:"transport,omitempty" json:"transport,omitempty"`
+	Timeout   time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+// RemapConfig rewrites From to To before routing.
+type RemapConfig struct {
+	From string `yaml:"from" json:"from"`
+	To   string `yaml:"to" json:"to"`
+}
+
+// ACLConfig grants permissions to clients inside CIDR. If Upstreams is
+// set, clients in CIDR are also routed to this pool instead of the
+// matched route's, regardless of the query name (AdGuard's
+// GetUpstreamsByClient idea: pin a subnet, e.g. an internal VPN range,
+// to its own resolvers).
+type ACLConfig struct {
+	CIDR          string           `yaml:"cidr" json:"cidr"`
+	AllowTransfer bool             `yaml:"allow_transfer,omitempty" json:"allow_transfer,omitempty"`
+	Upstreams     []UpstreamConfig `yaml:"upstreams,omitempty" json:"upstreams,omitempty"`
+}
+
+// Config is the on-disk representation of the proxy's routing table.
+type Config struct {
+	Address string        `yaml:"address,omitempty" json:"address,omitempty"`
+	Routes  []RouteConfig `yaml:"routes" json:"routes"`
+	Remaps  []RemapConfig `yaml:"remaps,omitempty" json:"remaps,omitempty"`
+	ACLs    []ACLConfig   `yaml:"acls,omitempty" json:"acls,omitempty"`
+}
+
+// Route is a compiled RouteConfig ready for lookup.
+type Route struct {
+	Suffix    string
+	Pool      *Pool
+	Transport string
+	Timeout   time.Duration
+}
+
+type clientACL struct {
+	net           *net.IPNet
+	allowTransfer bool
+	pool          *Pool // non-nil if this CIDR overrides upstream selection
+}
+
+// Router holds the compiled, queryable routing table. It is swapped
+// atomically on reload so in-flight queries always see a consistent
+// snapshot and are never dropped mid-lookup.
+type Router struct {
+	routes       *suffixTrie // suffix -> *Route
+	defaultRoute *Route
+	remaps       *suffixTrie // suffix -> string (destination suffix)
+	acls         []clientACL
+	stop         chan struct{} // closed when this Router is replaced
+}
+
+// route returns the most specific Route matching name, falling back to
+// the default route.
+func (r *Router) route(name string) *Route {
+	if v, ok := r.routes.longestMatch(name); ok {
+		return v.(*Route)
+	}
+	return r.defaultRoute
+}
+
+// remap returns the rewritten name and the (src, dst) suffixes applied,
+// or ("", "") if nothing matched.
+func (r *Router) remap(name string) (rewritten, src, dst string) {
+	v, ok := r.remaps.longestMatch(name)
+	if !ok {
+		return name, "", ""
+	}
+	from, to := v.(remapEntry).from, v.(remapEntry).to
+	return strings.Replace(name, from, to, 1), from, to
+}
+
+// remapEntry is the value stored in the remaps trie: the full source
+// suffix alongside its destination, since the trie only hands back the
+// node reached by the longest match.
+type remapEntry struct {
+	from, to string
+}
+
+// allowTransfer reports whether remote is permitted to perform AXFR/IXFR.
+func (r *Router) allowTransfer(remote net.IP) bool {
+	for _, acl := range r.acls {
+		if acl.allowTransfer && acl.net.Contains(remote) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientPool returns the upstream pool pinned to remote by an ACL's
+// Upstreams entry, if any, overriding the pool the queried name would
+// otherwise route to.
+func (r *Router) clientPool(remote net.IP) (*Pool, bool) {
+	for _, acl := range r.acls {
+		if acl.pool != nil && acl.net.Contains(remote) {
+			return acl.pool, true
+		}
+	}
+	return nil, false
+}
+
+// loadConfig reads and compiles the routing table at path. The format
+// (YAML or JSON) is inferred from the file extension.
+func loadConfig(path string) (*Router, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	switch ext := filepath.Ext(path); ext {
+	case ".json":
+		err = json.Unmarshal(data, &cfg)
+	default:
+		err = yaml.Unmarshal(data, &cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return compileConfig(&cfg)
+}
+
+// compileConfig validates cfg and builds a Router from it.
+func compileConfig(cfg *Config) (*Router, error) {
+	router := &Router{routes: newSuffixTrie(), remaps: newSuffixTrie(), stop: make(chan struct{})}
+	for _, rc := range cfg.Routes {
+		if len(rc.Upstreams) == 0 {
+			return nil, fmt.Errorf("route %q has no upstreams", rc.Suffix)
+		}
+		switch rc.Transport {
+		case "", "udp", "tcp":
+		default:
+			return nil, fmt.Errorf("route %q: invalid transport %q (want \"udp\" or \"tcp\")", rc.Suffix, rc.Transport)
+		}
+		route := &Route{
+			Suffix:    rc.Suffix,
+			Pool:      newPool(rc.Upstreams, *upstreamStrategy),
+			Transport: rc.Transport,
+			Timeout:   rc.Timeout,
+		}
+		route.Pool.startHealthChecks(*healthCheckInterval, router.stop)
+		if rc.Suffix == "" || rc.Suffix == "." {
+			route.Suffix = "."
+			router.defaultRoute = route
+			continue
+		}
+		route.Suffix = normalizeSuffix(route.Suffix)
+		router.routes.insert(route.Suffix, route)
+	}
+	if router.defaultRoute == nil {
+		return nil, fmt.Errorf("config has no default route (suffix \".\")")
+	}
+	for _, rm := range cfg.Remaps {
+		from, to := normalizeSuffix(rm.From), normalizeSuffix(rm.To)
+		router.remaps.insert(from, remapEntry{from: from, to: to})
+	}
+	for _, a := range cfg.ACLs {
+		_, ipnet, err := net.ParseCIDR(a.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid acl cidr %q: %v", a.CIDR, err)
+		}
+		acl := clientACL{net: ipnet, allowTransfer: a.AllowTransfer}
+		if len(a.Upstreams) > 0 {
+			acl.pool = newPool(a.Upstreams, *upstreamStrategy)
+			acl.pool.startHealthChecks(*healthCheckInterval, router.stop)
+		}
+		router.acls = append(router.acls, acl)
+	}
+	return router, nil
+}
+
+// normalizeSuffix turns a config-file suffix into the fully-qualified,
+// dot-terminated form the trie expects. A leading "." (as in the
+// package doc's "suffix: .example.com." example, meant to read as
+// "example.com and everything under it") is stripped rather than
+// inserted as a literal empty label, which would make the suffix match
+// one level too deep and never match the bare name itself.
+func normalizeSuffix(s string) string {
+	s = strings.TrimPrefix(s, ".")
+	if !strings.HasSuffix(s, ".") {
+		s += "."
+	}
+	return s
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testConfig() *Config {
+	return &Config{
+		Routes: []RouteConfig{
+			{Suffix: "example.com.", Upstreams: []UpstreamConfig{{Address: "127.0.0.1:8853"}}},
+			{Suffix: ".", Upstreams: []UpstreamConfig{{Address: "127.0.0.1:8854"}}},
+		},
+		Remaps: []RemapConfig{
+			{From: "old.example.net.", To: "example.com."},
+		},
+		ACLs: []ACLConfig{
+			{CIDR: "10.0.0.0/8", AllowTransfer: true},
+			{CIDR: "192.168.0.0/16", Upstreams: []UpstreamConfig{{Address: "127.0.0.1:8855"}}},
+		},
+	}
+}
+
+// stopRouterOnCleanup closes r's stop channel when the test finishes, so
+// its health-check goroutines don't leak across tests.
+func stopRouterOnCleanup(t *testing.T, r *Router) *Router {
+	t.Helper()
+	t.Cleanup(func() { close(r.stop) })
+	return r
+}
+
+// compileTestConfig compiles cfg and tears down its health-check
+// goroutines when the test finishes.
+func compileTestConfig(t *testing.T, cfg *Config) *Router {
+	t.Helper()
+	r, err := compileConfig(cfg)
+	if err != nil {
+		t.Fatalf("compileConfig: %v", err)
+	}
+	return stopRouterOnCleanup(t, r)
+}
+
+func TestCompileConfigRouting(t *testing.T) {
+	r := compileTestConfig(t, testConfig())
+
+	if rt := r.route("foo.example.com."); rt.Suffix != "example.com." {
+		t.Errorf("route(foo.example.com.) suffix = %q, want example.com.", rt.Suffix)
+	}
+	if rt := r.route("example.net."); rt.Suffix != "." {
+		t.Errorf("route(example.net.) suffix = %q, want . (default)", rt.Suffix)
+	}
+}
+
+func TestCompileConfigRemap(t *testing.T) {
+	r := compileTestConfig(t, testConfig())
+
+	rewritten, src, dst := r.remap("old.example.net.")
+	if rewritten != "example.com." || src != "old.example.net." || dst != "example.com." {
+		t.Errorf("remap(old.example.net.) = (%q, %q, %q), want (example.com., old.example.net., example.com.)", rewritten, src, dst)
+	}
+	if rewritten, _, _ := r.remap("unrelated.net."); rewritten != "unrelated.net." {
+		t.Errorf("remap(unrelated.net.) = %q, want unchanged", rewritten)
+	}
+}
+
+func TestCompileConfigACLs(t *testing.T) {
+	r := compileTestConfig(t, testConfig())
+
+	if !r.allowTransfer(net.ParseIP("10.1.2.3")) {
+		t.Error("allowTransfer(10.1.2.3) = false, want true (inside 10.0.0.0/8)")
+	}
+	if r.allowTransfer(net.ParseIP("192.168.1.1")) {
+		t.Error("allowTransfer(192.168.1.1) = true, want false (no allow_transfer on that ACL)")
+	}
+
+	pool, ok := r.clientPool(net.ParseIP("192.168.1.1"))
+	if !ok || pool == nil {
+		t.Fatal("clientPool(192.168.1.1) = not found, want the 192.168.0.0/16 ACL's pool")
+	}
+	if _, ok := r.clientPool(net.ParseIP("10.1.2.3")); ok {
+		t.Error("clientPool(10.1.2.3) = found, want false (that ACL has no Upstreams)")
+	}
+}
+
+func TestCompileConfigRejectsRouteWithNoUpstreams(t *testing.T) {
+	cfg := &Config{Routes: []RouteConfig{{Suffix: "."}}}
+	if _, err := compileConfig(cfg); err == nil {
+		t.Fatal("compileConfig with a route that has no upstreams = no error, want one")
+	}
+}
+
+func TestCompileConfigRejectsMissingDefaultRoute(t *testing.T) {
+	cfg := &Config{Routes: []RouteConfig{
+		{Suffix: "example.com.", Upstreams: []UpstreamConfig{{Address: "127.0.0.1:53"}}},
+	}}
+	if _, err := compileConfig(cfg); err == nil {
+		t.Fatal("compileConfig with no suffix \".\" route = no error, want one")
+	}
+}
+
+func TestCompileConfigRejectsInvalidTransport(t *testing.T) {
+	cfg := &Config{Routes: []RouteConfig{
+		{Suffix: ".", Upstreams: []UpstreamConfig{{Address: "127.0.0.1:53"}}, Transport: "quic"},
+	}}
+	if _, err := compileConfig(cfg); err == nil {
+		t.Fatal("compileConfig with transport \"quic\" = no error, want one (only udp/tcp are valid)")
+	}
+}
+
+func TestCompileConfigRejectsInvalidACLCIDR(t *testing.T) {
+	cfg := &Config{
+		Routes: []RouteConfig{{Suffix: ".", Upstreams: []UpstreamConfig{{Address: "127.0.0.1:53"}}}},
+		ACLs:   []ACLConfig{{CIDR: "not-a-cidr"}},
+	}
+	if _, err := compileConfig(cfg); err == nil {
+		t.Fatal("compileConfig with an invalid ACL CIDR = no error, want one")
+	}
+}
+
+func TestCompileConfigLeadingDotSuffix(t *testing.T) {
+	cfg := &Config{Routes: []RouteConfig{
+		{Suffix: ".example.com.", Upstreams: []UpstreamConfig{{Address: "127.0.0.1:8853"}}},
+		{Suffix: ".", Upstreams: []UpstreamConfig{{Address: "127.0.0.1:8854"}}},
+	}}
+	r := compileTestConfig(t, cfg)
+
+	for _, name := range []string{"example.com.", "sub.example.com."} {
+		if rt := r.route(name); rt.Suffix == "." {
+			t.Errorf("route(%q) fell through to the default route, want the .example.com. route", name)
+		}
+	}
+}
+
+func TestLoadConfigYAMLAndJSON(t *testing.T) {
+	dir := t.TempDir()
+
+	yamlPath := filepath.Join(dir, "config.yaml")
+	yamlBody := "routes:\n  - suffix: .\n    upstreams:\n      - address: 127.0.0.1:8853\n"
+	if err := os.WriteFile(yamlPath, []byte(yamlBody), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r := compileTestConfigFromPath(t, yamlPath)
+	if rt := r.route("example.com."); rt.Suffix != "." {
+		t.Errorf("route from loaded YAML config = %q, want default route", rt.Suffix)
+	}
+
+	jsonPath := filepath.Join(dir, "config.json")
+	jsonBody := `{"routes":[{"suffix":".","upstreams":[{"address":"127.0.0.1:8853"}]}]}`
+	if err := os.WriteFile(jsonPath, []byte(jsonBody), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r = compileTestConfigFromPath(t, jsonPath)
+	if rt := r.route("example.com."); rt.Suffix != "." {
+		t.Errorf("route from loaded JSON config = %q, want default route", rt.Suffix)
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("loadConfig on a missing file = no error, want one")
+	}
+}
+
+func compileTestConfigFromPath(t *testing.T, path string) *Router {
+	t.Helper()
+	r, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig(%s): %v", path, err)
+	}
+	return stopRouterOnCleanup(t, r)
+}
@@ -4,16 +4,71 @@ Binary dns_reverse_proxy is a DNS reverse proxy to route queries to DNS servers.
 To illustrate, imagine an HTTP reverse proxy but for DNS.
 It listens on both TCP/UDP IPv4/IPv6 on specified port.
 Since the upstream servers will not see the real client IPs but the proxy,
-you can specify a list of IPs allowed to transfer (AXFR/IXFR).
+the config file's ACLs control which clients are allowed to transfer
+(AXFR/IXFR), and can also pin a client CIDR to its own upstream pool,
+overriding the matched route regardless of the query name.
+
+Routing, remaps and transfer ACLs are no longer flags: they live in a
+config file (YAML or JSON) loaded with -config. The file is watched for
+changes and reloaded on write, or on SIGHUP, without dropping in-flight
+queries.
 
 Example usage:
-        $ go run dns_reverse_proxy.go -address :53 \
-                -default 8.8.8.8:53 \
-                -route .example.com.=8.8.4.4:53 \
-                -allow-transfer 1.2.3.4,::1
 
-A query for example.net or example.com will go to 8.8.8.8:53, the default.
-However, a query for subdomain.example.com will go to 8.8.4.4:53.
+	$ go run . -address :53 -config dns_reverse_proxy.yaml
+
+Example dns_reverse_proxy.yaml:
+
+	routes:
+	  - suffix: .example.com.
+	    upstreams:
+	      - address: 8.8.4.4:53
+	  - suffix: .
+	    upstreams:
+	      - address: 8.8.8.8:53
+	acls:
+	  - cidr: 1.2.3.4/32
+	    allow_transfer: true
+
+A query for example.net will go to 8.8.8.8:53, the default route (suffix
+"."). A query for example.com or subdomain.example.com will go to
+8.8.4.4:53, matching the "example.com." route and everything under it.
+
+Pass -cache-size to cache responses in memory, honoring the minimum TTL
+of the answer (or, for NXDOMAIN/NODATA, the SOA MINIMUM per RFC 2308).
+
+A route's upstreams list is a pool: unhealthy servers (tracked via
+periodic SOA probes) are skipped, -retries controls failover on
+SERVFAIL/timeout, and -strategy picks round-robin, random, latency, or
+first-healthy selection among the healthy ones.
+
+An upstream address may carry a scheme to use DoT (tls://host:853), DoH
+(https://host/path) or DoQ (quic://host:784) instead of plain UDP/TCP.
+Use -bootstrap to resolve DoH hostnames without relying on the system
+resolver, and -tls-insecure to skip certificate verification in lab
+setups.
+
+-bogus-nxdomain rewrites a response to NXDOMAIN when every A/AAAA record
+in it falls inside a configured IP/CIDR list, e.g. the sinkhole
+addresses some ISPs and captive portals return for names that don't
+exist.
+
+-ecs forwards an EDNS Client Subnet option derived from the querying
+client's address to upstreams (truncated to -ecs-v4-prefix/
+-ecs-v6-prefix bits), so upstreams can make geo-aware answers despite
+only ever seeing the proxy's own address otherwise. Client-supplied ECS
+is always preserved untouched, -ecs-allow restricts which clients opt
+in, and ECS is stripped from the response to any client that didn't
+send it itself.
+
+-metrics serves Prometheus counters/histograms (QPS by qtype, upstream
+latency and errors, per-route hit counts, cache hit ratio, AXFR attempts
+by allowed="true"/"false") at /metrics. -querylog writes a JSON-per-line
+record of every query answered (client IP, qname, qtype, matched route,
+upstream, rcode, latency, remap applied; upstream is "cache" for a
+cache hit) to a file, rotating it past -querylog-max-size. Queries that
+fail before an answer exists (denied transfers, exhausted retries) are
+only reflected in the Prometheus counters above, not the query log.
 */
 package main
 
@@ -23,8 +78,11 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -32,62 +90,103 @@ import (
 var (
 	address = flag.String("address", ":53", "Address to listen to (TCP and UDP)")
 
-	defaultServer = flag.String("default", "",
-		"Default DNS server where to send queries if no route matched (IP:port)")
+	configPath = flag.String("config", "",
+		"Path to the routing config file (YAML or JSON)")
 
-	routeList = flag.String("route", "",
-		"List of routes where to send queries (subdomain=IP:port)")
-	routes map[string]string
+	cacheSize = flag.Int("cache-size", 0,
+		"Max number of responses to cache (0 disables caching)")
+	cacheMaxTTL = flag.Duration("cache-max-ttl", 1*time.Hour,
+		"Upper bound on how long a cached response is served, regardless of its own TTL")
+	cacheDNSSECAware = flag.Bool("cache-dnssec-aware", false,
+		"Cache responses to queries with the DNSSEC OK (DO) bit set instead of bypassing the cache for them")
+	metricsAddr = flag.String("metrics", "",
+		"Address to serve /metrics on (empty disables it)")
 
-	remapList = flag.String("remap", "",
-		"List of remaps to translate a domain to another (srcdomain=dstdomain)")
-	remaps map[string]string
+	upstreamStrategy = flag.String("strategy", "round-robin",
+		"Upstream selection strategy: round-robin, random, latency, or first-healthy")
+	retries = flag.Int("retries", 1,
+		"Number of additional upstreams to try after a SERVFAIL or timeout")
+	healthCheckInterval = flag.Duration("health-check-interval", 10*time.Second,
+		"How often to probe unhealthy upstreams")
 
-	allowTransfer = flag.String("allow-transfer", "",
-		"List of IPs allowed to transfer (AXFR/IXFR)")
-	transferIPs []string
-)
+	bootstrap = flag.String("bootstrap", "",
+		"Plain DNS server (IP:port) used to resolve DoH upstream hostnames")
+	tlsInsecure = flag.Bool("tls-insecure", false,
+		"Skip TLS certificate verification for DoT/DoH/DoQ upstreams (lab use only)")
+
+	bogusNXDomain = flag.String("bogus-nxdomain", "",
+		"Comma-separated IPs/CIDRs (e.g. sinkhole addresses) that turn a response into NXDOMAIN")
+	bogusSet *ipSet
+
+	ecsEnabled = flag.Bool("ecs", false,
+		"Forward an EDNS Client Subnet option to upstreams derived from the querying client's address")
+	ecsV4Prefix  = flag.Int("ecs-v4-prefix", 24, "Source prefix length for IPv4 EDNS Client Subnet")
+	ecsV6Prefix  = flag.Int("ecs-v6-prefix", 56, "Source prefix length for IPv6 EDNS Client Subnet")
+	ecsAllowList = flag.String("ecs-allow", "",
+		"Comma-separated client IPs/CIDRs that opt in to ECS forwarding (empty allows all clients)")
+	ecsAllow *ipSet
 
+	querylogPath = flag.String("querylog", "",
+		"Path to write JSON-per-line query log records to (empty disables it)")
+	querylogMaxSize = flag.Int64("querylog-max-size", 100<<20,
+		"Rotate the query log once it exceeds this many bytes (0 disables rotation)")
+	querylog *queryLogger
 
-func parse_list() {}
+	router atomic.Value // holds *Router
+
+	respCache *Cache
+)
+
+func currentRouter() *Router {
+	return router.Load().(*Router)
+}
 
 func main() {
 	flag.Parse()
-	if *defaultServer == "" {
-		log.Fatal("-default is required")
-	}
-	transferIPs = strings.Split(*allowTransfer, ",")
-	routes = make(map[string]string)
-	if *routeList != "" {
-		for _, s := range strings.Split(*routeList, ",") {
-			s := strings.SplitN(s, "=", 2)
-			if len(s) != 2 {
-				log.Fatal("invalid -routes format")
-			}
-			if !strings.HasSuffix(s[0], ".") {
-				s[0] += "."
-			}
-			routes[s[0]] = s[1]
+	if *configPath == "" {
+		log.Fatal("-config is required")
+	}
+
+	if *bogusNXDomain != "" {
+		var err error
+		bogusSet, err = newIPSet(*bogusNXDomain)
+		if err != nil {
+			log.Fatalf("-bogus-nxdomain: %v", err)
+		}
+	}
+	if *ecsAllowList != "" {
+		var err error
+		ecsAllow, err = newIPSet(*ecsAllowList)
+		if err != nil {
+			log.Fatalf("-ecs-allow: %v", err)
 		}
 	}
 
-	remaps = make(map[string]string)
-	if *remapList != "" {
-		for _, s := range strings.Split(*remapList, ",") {
-			s := strings.SplitN(s, "=", 2)
-			if len(s) != 2 {
-				log.Fatal("invalid -remap format")
-			}
-			if !strings.HasSuffix(s[0], ".") {
-				s[0] += "."
-			}
-			remaps[s[0]] = s[1]
+	initial, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("loading %s: %v", *configPath, err)
+	}
+	router.Store(initial)
+	watchConfig(*configPath, &router)
+
+	if *cacheSize > 0 {
+		respCache = newCache(*cacheSize, *cacheMaxTTL)
+		registerCacheMetrics(respCache)
+	}
+	if *metricsAddr != "" {
+		serveMetrics(*metricsAddr)
+	}
+	if *querylogPath != "" {
+		var err error
+		querylog, err = newQueryLogger(*querylogPath, *querylogMaxSize)
+		if err != nil {
+			log.Fatalf("-querylog: %v", err)
 		}
 	}
 
 	udpServer := &dns.Server{Addr: *address, Net: "udp"}
 	tcpServer := &dns.Server{Addr: *address, Net: "tcp"}
-	dns.HandleFunc(".", route)
+	dns.HandleFunc(".", withMetrics(route))
 	go func() {
 		if err := udpServer.ListenAndServe(); err != nil {
 			log.Fatal(err)
@@ -113,23 +212,74 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 		dns.HandleFailed(w, req)
 		return
 	}
-	var matched_src, matched_dst string
-	for src, dst := range remaps {
-		if strings.HasSuffix(req.Question[0].Name, src) {
-			matched_src = src
-			matched_dst = dst
-			req.Question[0].Name = strings.Replace(req.Question[0].Name, src, dst, 1)
-			break
+	r := currentRouter()
+
+	origQuestion := req.Question[0]
+	cacheOK := respCache != nil && cacheable(req)
+	if cacheOK {
+		if resp, ok := respCache.get(origQuestion); ok {
+			resp.Id = req.Id
+			// Entries obtained using a client- or proxy-injected ECS
+			// subnet are never cached (see ecsScoped below), so this is
+			// belt-and-suspenders against any ECS option an upstream
+			// attached on its own.
+			if *ecsEnabled && !hasECS(req) {
+				stripECS(resp)
+			}
+			w.WriteMsg(resp)
+			if querylog != nil {
+				remote, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+				querylog.log(queryLogEntry{
+					Timestamp: time.Now(),
+					ClientIP:  remote,
+					Qname:     origQuestion.Name,
+					Qtype:     dns.TypeToString[origQuestion.Qtype],
+					Upstream:  "cache",
+					Rcode:     dns.RcodeToString[resp.Rcode],
+				})
+			}
+			return
 		}
 	}
 
-	for name, addr := range routes {
-		if strings.HasSuffix(req.Question[0].Name, name) {
-			proxy(addr, w, req, matched_src, matched_dst)
-			return
+	name, src, dst := r.remap(req.Question[0].Name)
+	req.Question[0].Name = name
+
+	rt := r.route(req.Question[0].Name)
+	routeHitsTotal.WithLabelValues(rt.Suffix).Inc()
+
+	remote, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	if pool, ok := r.clientPool(net.ParseIP(remote)); ok {
+		overridden := *rt
+		overridden.Pool = pool
+		rt = &overridden
+	}
+
+	start := time.Now()
+	outcome := proxy(rt, w, req, src, dst)
+	if outcome == nil {
+		return
+	}
+	if cacheOK && !outcome.ecsScoped {
+		respCache.set(origQuestion, outcome.resp)
+	}
+	if querylog != nil {
+		remapped := ""
+		if src != "" {
+			remapped = src + "->" + dst
 		}
+		querylog.log(queryLogEntry{
+			Timestamp: start,
+			ClientIP:  remote,
+			Qname:     origQuestion.Name,
+			Qtype:     dns.TypeToString[origQuestion.Qtype],
+			Route:     rt.Suffix,
+			Upstream:  outcome.upstream,
+			Rcode:     dns.RcodeToString[outcome.resp.Rcode],
+			LatencyMS: float64(time.Since(start)) / float64(time.Millisecond),
+			Remap:     remapped,
+		})
 	}
-	proxy(*defaultServer, w, req, matched_src, matched_dst)
 }
 
 func isTransfer(req *dns.Msg) bool {
@@ -147,15 +297,29 @@ func allowed(w dns.ResponseWriter, req *dns.Msg) bool {
 		return true
 	}
 	remote, _, _ := net.SplitHostPort(w.RemoteAddr().String())
-	for _, ip := range transferIPs {
-		if ip == remote {
-			return true
-		}
-	}
-	return false
+	ok := currentRouter().allowTransfer(net.ParseIP(remote))
+	axfrAttemptsTotal.WithLabelValues(strconv.FormatBool(ok)).Inc()
+	return ok
+}
+
+// proxyOutcome is what proxy() learned answering a (non-transfer) query,
+// for the caller to cache and query-log.
+type proxyOutcome struct {
+	resp      *dns.Msg
+	upstream  string
+	ecsScoped bool // resp was obtained using a client- or proxy-supplied ECS subnet; never safe to cache under the ECS-blind (qname, qtype, qclass) key
 }
 
-func proxy(addr string, w dns.ResponseWriter, req *dns.Msg, src string, dst string) {
+// proxy forwards req to rt's upstream and writes the reply to w. It
+// returns a proxyOutcome describing the response (with any remap
+// reversed), or nil if nothing cacheable/loggable was written (a
+// transfer, or a failure already reported via dns.HandleFailed).
+func proxy(rt *Route, w dns.ResponseWriter, req *dns.Msg, src string, dst string) *proxyOutcome {
+	candidates := rt.Pool.order()
+	if len(candidates) == 0 {
+		dns.HandleFailed(w, req)
+		return nil
+	}
 	transport := "udp"
 	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
 		transport = "tcp"
@@ -163,33 +327,112 @@ func proxy(addr string, w dns.ResponseWriter, req *dns.Msg, src string, dst stri
 	if isTransfer(req) {
 		if transport != "tcp" {
 			dns.HandleFailed(w, req)
-			return
+			return nil
 		}
+		addr := candidates[0].Address
 		t := new(dns.Transfer)
 		c, err := t.In(req, addr)
 		if err != nil {
 			dns.HandleFailed(w, req)
-			return
+			return nil
 		}
 		if err = t.Out(w, req, c); err != nil {
 			dns.HandleFailed(w, req)
-			return
+			return nil
 		}
-		return
+		return nil
 	}
-	c := &dns.Client{Net: transport}
-	resp, _, err := c.Exchange(req, addr)
-	if err != nil && err != dns.ErrTruncated {
-		// go ahead and return truncated so client can retry tcp if they want
-		log.Printf("err: %v\n", err)
+
+	// rt.Transport overrides the client-driven choice above for plain
+	// (non tls://, https://, quic://) upstreams, e.g. to always speak
+	// TCP upstream even for UDP-originated queries.
+	upstreamTransport := transport
+	if rt.Transport != "" {
+		upstreamTransport = rt.Transport
+	}
+
+	clientHadECS := hasECS(req)
+	if *ecsEnabled {
+		remote, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		injectECS(req, net.ParseIP(remote))
+	}
+	// injectedECS is true when we (not the client) attached a subnet
+	// derived from the client's own address, e.g. because it's in
+	// -ecs-allow. The resulting answer is just as subnet-specific as one
+	// driven by a client-supplied option, even though it's stripped
+	// before the reply and so never visibly leaks.
+	injectedECS := !clientHadECS && hasECS(req)
+
+	attempts := *retries + 1
+	if attempts > len(candidates) {
+		attempts = len(candidates)
+	}
+	var resp *dns.Msg
+	var err error
+	var usedUpstream string
+	for i := 0; i < attempts; i++ {
+		upstream := candidates[i]
+		var rtt time.Duration
+		resp, rtt, err = exchangeUpstream(req, upstream, upstreamTransport, rt.Timeout)
+		if err != nil {
+			log.Printf("err: %v\n", err)
+			upstreamErrorsTotal.WithLabelValues(upstream.Address).Inc()
+			upstream.recordFailure(2)
+			continue
+		}
+		upstreamLatencySeconds.WithLabelValues(upstream.Address).Observe(rtt.Seconds())
+		if resp.Rcode == dns.RcodeServerFailure {
+			upstreamErrorsTotal.WithLabelValues(upstream.Address).Inc()
+			upstream.recordFailure(2)
+			continue
+		}
+		upstream.recordSuccess(rtt)
+		usedUpstream = upstream.Address
+		break
+	}
+	if err != nil {
 		dns.HandleFailed(w, req)
-		return
+		return nil
 	}
+	// A truncated resp (resp.Truncated) is still returned here with a nil
+	// err, not a distinct error: we hand it back as-is so the client can
+	// retry over TCP if it wants to.
 	if src != "" {
 		resp.Question[0].Name = strings.Replace(resp.Question[0].Name, dst, src, 1)
 		for _, ans := range resp.Answer {
 			ans.Header().Name = strings.Replace(ans.Header().Name, dst, src, 1)
 		}
 	}
+	if bogusSet != nil && isBogusAnswer(resp) {
+		resp.Rcode = dns.RcodeNameError
+		resp.Answer = nil
+	}
+	if *ecsEnabled && !clientHadECS {
+		stripECS(resp)
+	}
 	w.WriteMsg(resp)
+	return &proxyOutcome{resp: resp, upstream: usedUpstream, ecsScoped: clientHadECS || injectedECS}
+}
+
+// isBogusAnswer reports whether every A/AAAA record in resp falls
+// inside -bogus-nxdomain, e.g. a captive-portal or ISP sinkhole address
+// returned for a name that doesn't actually exist.
+func isBogusAnswer(resp *dns.Msg) bool {
+	sawAddress := false
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		sawAddress = true
+		if !bogusSet.contains(ip) {
+			return false
+		}
+	}
+	return sawAddress
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// hasECS reports whether req already carries an EDNS0 Client Subnet
+// option, e.g. because it came from another ECS-aware proxy upstream of
+// us.
+func hasECS(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// injectECS adds an EDNS0 Client Subnet option derived from clientIP to
+// req, truncated to -ecs-v4-prefix/-ecs-v6-prefix bits, unless req
+// already carries one (client-supplied ECS is always preserved as-is)
+// or clientIP isn't in -ecs-allow.
+func injectECS(req *dns.Msg, clientIP net.IP) {
+	if clientIP == nil || !ecsClientOptedIn(clientIP) || hasECS(req) {
+		return
+	}
+	opt := req.IsEdns0()
+	if opt == nil {
+		opt = new(dns.OPT)
+		opt.Hdr.Name = "."
+		opt.Hdr.Rrtype = dns.TypeOPT
+		req.Extra = append(req.Extra, opt)
+	}
+
+	e := new(dns.EDNS0_SUBNET)
+	e.Code = dns.EDNS0SUBNET
+	if ip4 := clientIP.To4(); ip4 != nil {
+		e.Family = 1
+		e.SourceNetmask = uint8(*ecsV4Prefix)
+		e.Address = ip4.Mask(net.CIDRMask(*ecsV4Prefix, 32))
+	} else {
+		e.Family = 2
+		e.SourceNetmask = uint8(*ecsV6Prefix)
+		e.Address = clientIP.Mask(net.CIDRMask(*ecsV6Prefix, 128))
+	}
+	opt.Option = append(opt.Option, e)
+}
+
+// stripECS removes any EDNS0 Client Subnet option from resp. Used to
+// hide the subnet we (or the upstream) attached from a client that
+// never asked for ECS in the first place.
+func stripECS(resp *dns.Msg) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+	kept := opt.Option[:0]
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_SUBNET); !ok {
+			kept = append(kept, o)
+		}
+	}
+	opt.Option = kept
+}
+
+// ecsClientOptedIn reports whether clientIP is allowed to have ECS
+// forwarded on its behalf. With no -ecs-allow list, every client is
+// opted in once -ecs is enabled.
+func ecsClientOptedIn(clientIP net.IP) bool {
+	if ecsAllow == nil {
+		return true
+	}
+	return ecsAllow.contains(clientIP)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ipTrieNode is one bit of a binary radix trie over IP addresses,
+// addresses being treated as 128-bit values (IPv4 mapped into the
+// IPv4-in-IPv6 range). It's the same "walk and remember the last
+// terminal node" idea as suffixTrie, just over bits instead of labels.
+type ipTrieNode struct {
+	children [2]*ipTrieNode
+	terminal bool
+}
+
+// ipSet is a set of IPs and CIDR ranges with O(bits) containment checks,
+// used to test every A/AAAA record in a response against
+// -bogus-nxdomain without a linear scan per query.
+type ipSet struct {
+	root *ipTrieNode
+}
+
+func newIPSet(entries string) (*ipSet, error) {
+	s := &ipSet{root: &ipTrieNode{}}
+	for _, e := range strings.Split(entries, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", e)
+			}
+			bits := "32"
+			if ip.To4() == nil {
+				bits = "128"
+			}
+			e = ip.String() + "/" + bits
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", e, err)
+		}
+		s.add(n)
+	}
+	return s, nil
+}
+
+func (s *ipSet) add(n *net.IPNet) {
+	ip := n.IP.To16()
+	ones, bits := n.Mask.Size()
+	start := 0
+	if bits == 32 {
+		start = 96 // offset of the IPv4-mapped range within a 128-bit address
+	}
+	node := s.root
+	for pos := start; pos < start+ones; pos++ {
+		b := bitAt(ip, pos)
+		if node.children[b] == nil {
+			node.children[b] = &ipTrieNode{}
+		}
+		node = node.children[b]
+	}
+	node.terminal = true
+}
+
+// contains reports whether ip falls within any registered range.
+func (s *ipSet) contains(ip net.IP) bool {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return false
+	}
+	start := 0
+	if ip.To4() != nil {
+		start = 96
+	}
+	node := s.root
+	if node.terminal {
+		return true
+	}
+	for pos := start; pos < 128; pos++ {
+		child := node.children[bitAt(ip16, pos)]
+		if child == nil {
+			return false
+		}
+		node = child
+		if node.terminal {
+			return true
+		}
+	}
+	return false
+}
+
+func bitAt(ip net.IP, pos int) int {
+	return int((ip[pos/8] >> uint(7-pos%8)) & 1)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// failureBackoff bounds how long an unhealthy upstream is skipped before
+// it's probed again, doubling with each consecutive failure.
+const (
+	minProbeBackoff = 5 * time.Second
+	maxProbeBackoff = 5 * time.Minute
+)
+
+// Upstream tracks the health and latency of a single upstream server so
+// Pool can avoid routing queries to one that's down or slow.
+type Upstream struct {
+	Address string
+	Weight  int
+
+	mu               sync.Mutex
+	healthy          bool
+	consecutiveFails int
+	backoff          time.Duration
+	nextProbe        time.Time
+	ewmaLatency      time.Duration
+}
+
+func newUpstream(addr string, weight int) *Upstream {
+	if weight <= 0 {
+		weight = 1
+	}
+	return &Upstream{Address: addr, Weight: weight, healthy: true, backoff: minProbeBackoff}
+}
+
+// recordSuccess marks u healthy and folds latency into its EWMA (alpha
+// of 0.2, i.e. it takes roughly the last 5 probes/queries into account).
+func (u *Upstream) recordSuccess(latency time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.healthy = true
+	u.consecutiveFails = 0
+	u.backoff = minProbeBackoff
+	if u.ewmaLatency == 0 {
+		u.ewmaLatency = latency
+		return
+	}
+	u.ewmaLatency = time.Duration(0.8*float64(u.ewmaLatency) + 0.2*float64(latency))
+}
+
+// recordFailure counts a failed query/probe, marking u unhealthy after
+// maxConsecutiveFails and scheduling the next health probe with
+// exponential backoff.
+func (u *Upstream) recordFailure(maxConsecutiveFails int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.consecutiveFails++
+	if u.consecutiveFails >= maxConsecutiveFails {
+		u.healthy = false
+		u.nextProbe = time.Now().Add(u.backoff)
+		if u.backoff *= 2; u.backoff > maxProbeBackoff {
+			u.backoff = maxProbeBackoff
+		}
+	}
+}
+
+func (u *Upstream) snapshot() (healthy bool, latency time.Duration, dueForProbe bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy, u.ewmaLatency, !u.healthy && !time.Now().Before(u.nextProbe)
+}
+
+// probe issues a lightweight SOA query against u and updates its health
+// based on the result.
+func (u *Upstream) probe() {
+	req := new(dns.Msg)
+	req.SetQuestion(".", dns.TypeSOA)
+	resp, rtt, err := exchangeUpstream(req, u, "udp", 2*time.Second)
+	if err != nil || resp == nil || resp.Rcode == dns.RcodeServerFailure {
+		u.recordFailure(1)
+		return
+	}
+	u.recordSuccess(rtt)
+}
+
+// Pool is a weighted set of upstream servers for one route, load
+// balanced and failed over according to strategy.
+type Pool struct {
+	upstreams []*Upstream
+	strategy  string
+	counter   uint64 // round-robin cursor
+}
+
+func newPool(upstreams []UpstreamConfig, strategy string) *Pool {
+	p := &Pool{strategy: strategy}
+	for _, u := range upstreams {
+		p.upstreams = append(p.upstreams, newUpstream(u.Address, u.Weight))
+	}
+	return p
+}
+
+// healthyUpstreams returns the currently healthy servers, or every
+// server if none are healthy (so the proxy degrades rather than fails
+// outright when a whole pool is flapping).
+func (p *Pool) healthyUpstreams() []*Upstream {
+	var healthy []*Upstream
+	for _, u := range p.upstreams {
+		if ok, _, _ := u.snapshot(); ok {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		return p.upstreams
+	}
+	return healthy
+}
+
+// maxWeightExpansion bounds how many times a single upstream is
+// repeated by expandByWeight, so one misconfigured huge weight can't
+// blow up the candidate list.
+const maxWeightExpansion = 16
+
+// expandByWeight repeats each upstream in candidates Weight times,
+// giving round-robin and random ordering a way to favor heavier
+// upstreams without a separate weighted-sampling algorithm.
+func expandByWeight(candidates []*Upstream) []*Upstream {
+	var expanded []*Upstream
+	for _, u := range candidates {
+		n := u.Weight
+		if n > maxWeightExpansion {
+			n = maxWeightExpansion
+		}
+		for i := 0; i < n; i++ {
+			expanded = append(expanded, u)
+		}
+	}
+	return expanded
+}
+
+// dedupeOrdered drops the repeats expandByWeight introduces, keeping
+// each upstream's first (i.e. most preferred) position.
+func dedupeOrdered(upstreams []*Upstream) []*Upstream {
+	seen := make(map[*Upstream]bool, len(upstreams))
+	out := make([]*Upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		if seen[u] {
+			continue
+		}
+		seen[u] = true
+		out = append(out, u)
+	}
+	return out
+}
+
+// order returns the candidate upstreams in the order proxy() should try
+// them, per the pool's strategy. "round-robin" and "random" weight by
+// Upstream.Weight; "latency" and "first-healthy" ignore it, since they
+// already order on a more direct signal (measured latency, or the
+// config's own listed order).
+func (p *Pool) order() []*Upstream {
+	candidates := p.healthyUpstreams()
+	switch p.strategy {
+	case "random":
+		expanded := expandByWeight(candidates)
+		rand.Shuffle(len(expanded), func(i, j int) { expanded[i], expanded[j] = expanded[j], expanded[i] })
+		return dedupeOrdered(expanded)
+	case "latency":
+		sorted := append([]*Upstream(nil), candidates...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			_, li, _ := sorted[i].snapshot()
+			_, lj, _ := sorted[j].snapshot()
+			if li == 0 {
+				return false
+			}
+			if lj == 0 {
+				return true
+			}
+			return li < lj
+		})
+		return sorted
+	case "first-healthy":
+		return candidates
+	default: // round-robin, weighted by Upstream.Weight
+		expanded := expandByWeight(candidates)
+		n := len(expanded)
+		if n == 0 {
+			return expanded
+		}
+		start := int(atomic.AddUint64(&p.counter, 1)) % n
+		rotated := append(append([]*Upstream(nil), expanded[start:]...), expanded[:start]...)
+		return dedupeOrdered(rotated)
+	}
+}
+
+// startHealthChecks periodically probes unhealthy upstreams until stop
+// is closed.
+func (p *Pool) startHealthChecks(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				for _, u := range p.upstreams {
+					if _, _, due := u.snapshot(); due {
+						go u.probe()
+					}
+				}
+			}
+		}
+	}()
+}
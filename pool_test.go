@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpstreamRecordFailureMarksUnhealthyAfterThreshold(t *testing.T) {
+	u := newUpstream("127.0.0.1:53", 1)
+
+	u.recordFailure(2)
+	if healthy, _, _ := u.snapshot(); !healthy {
+		t.Fatal("upstream marked unhealthy before reaching maxConsecutiveFails")
+	}
+
+	u.recordFailure(2)
+	healthy, _, due := u.snapshot()
+	if healthy {
+		t.Fatal("upstream should be unhealthy after maxConsecutiveFails")
+	}
+	if due {
+		t.Fatal("upstream should not be due for a probe immediately after going unhealthy (backoff not elapsed)")
+	}
+}
+
+func TestUpstreamRecordSuccessResetsBackoff(t *testing.T) {
+	u := newUpstream("127.0.0.1:53", 1)
+	u.recordFailure(1)
+	if healthy, _, _ := u.snapshot(); healthy {
+		t.Fatal("expected upstream to be unhealthy after one failure at maxConsecutiveFails=1")
+	}
+
+	u.recordSuccess(10 * time.Millisecond)
+	healthy, latency, _ := u.snapshot()
+	if !healthy {
+		t.Fatal("expected recordSuccess to mark the upstream healthy again")
+	}
+	if latency != 10*time.Millisecond {
+		t.Fatalf("ewmaLatency after first sample = %v, want 10ms", latency)
+	}
+	if u.backoff != minProbeBackoff {
+		t.Fatalf("backoff after recordSuccess = %v, want reset to %v", u.backoff, minProbeBackoff)
+	}
+}
+
+func TestUpstreamBackoffDoublesAndCaps(t *testing.T) {
+	u := newUpstream("127.0.0.1:53", 1)
+	var last time.Duration
+	for i := 0; i < 10; i++ {
+		u.recordFailure(1)
+		if u.backoff < last {
+			t.Fatalf("backoff decreased: %v -> %v", last, u.backoff)
+		}
+		last = u.backoff
+	}
+	if u.backoff > maxProbeBackoff {
+		t.Fatalf("backoff = %v, exceeds cap %v", u.backoff, maxProbeBackoff)
+	}
+}
+
+func TestPoolHealthyUpstreamsFallsBackWhenAllDown(t *testing.T) {
+	p := newPool([]UpstreamConfig{{Address: "1.1.1.1:53"}, {Address: "2.2.2.2:53"}}, "round-robin")
+	for _, u := range p.upstreams {
+		u.recordFailure(1)
+	}
+	healthy := p.healthyUpstreams()
+	if len(healthy) != len(p.upstreams) {
+		t.Fatalf("healthyUpstreams() = %d upstreams, want all %d to degrade rather than return none", len(healthy), len(p.upstreams))
+	}
+}
+
+func TestPoolOrderRoundRobinWeighted(t *testing.T) {
+	p := newPool([]UpstreamConfig{
+		{Address: "1.1.1.1:53", Weight: 1},
+		{Address: "2.2.2.2:53", Weight: 3},
+	}, "round-robin")
+
+	counts := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		counts[p.order()[0].Address]++
+	}
+	if counts["2.2.2.2:53"] <= counts["1.1.1.1:53"] {
+		t.Fatalf("weighted round-robin picked the weight-3 upstream first %d times vs %d for weight-1, want it picked more often", counts["2.2.2.2:53"], counts["1.1.1.1:53"])
+	}
+}
+
+func TestPoolOrderDedupes(t *testing.T) {
+	p := newPool([]UpstreamConfig{{Address: "1.1.1.1:53", Weight: 5}}, "round-robin")
+	order := p.order()
+	if len(order) != 1 {
+		t.Fatalf("order() = %d entries for one weighted upstream, want 1 (deduped)", len(order))
+	}
+}
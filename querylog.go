@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// queryLogEntry is one JSON-per-line record written by -querylog.
+type queryLogEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	ClientIP  string    `json:"client_ip"`
+	Qname     string    `json:"qname"`
+	Qtype     string    `json:"qtype"`
+	Route     string    `json:"route"`
+	Upstream  string    `json:"upstream"`
+	Rcode     string    `json:"rcode"`
+	LatencyMS float64   `json:"latency_ms"`
+	Remap     string    `json:"remap,omitempty"`
+}
+
+// queryLogger appends JSON query log records to a file, rotating it to
+// a timestamped name once it exceeds maxBytes.
+type queryLogger struct {
+	path     string
+	maxBytes int64
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newQueryLogger(path string, maxBytes int64) (*queryLogger, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &queryLogger{path: path, maxBytes: maxBytes, file: f, size: info.Size()}, nil
+}
+
+func (q *queryLogger) log(e queryLogEntry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("querylog: marshal failed: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.maxBytes > 0 && q.size+int64(len(line)) > q.maxBytes {
+		q.rotateLocked()
+	}
+	n, err := q.file.Write(line)
+	if err != nil {
+		log.Printf("querylog: write failed: %v", err)
+		return
+	}
+	q.size += int64(n)
+}
+
+// rotateLocked must be called with q.mu held.
+func (q *queryLogger) rotateLocked() {
+	q.file.Close()
+	rotated := fmt.Sprintf("%s.%s", q.path, time.Now().UTC().Format("20060102T150405Z"))
+	renamed := true
+	if err := os.Rename(q.path, rotated); err != nil {
+		log.Printf("querylog: rotate failed, appending to the existing file instead: %v", err)
+		renamed = false
+	}
+	f, err := os.OpenFile(q.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("querylog: reopen after rotate failed: %v", err)
+		return
+	}
+	q.file = f
+	q.size = 0
+	if !renamed {
+		if info, err := f.Stat(); err == nil {
+			q.size = info.Size()
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// upstreamScheme reports the transport an upstream address asks for and
+// the address to actually dial, stripping the scheme prefix.
+//
+//	1.1.1.1:53                 -> "", "1.1.1.1:53"              (plain UDP/TCP)
+//	tls://1.1.1.1:853          -> "tls", "1.1.1.1:853"           (DoT)
+//	https://dns.example/query  -> "https", "https://dns.example/query" (DoH)
+//	quic://dns.example:784     -> "quic", "dns.example:784"      (DoQ)
+func upstreamScheme(addr string) (scheme, target string) {
+	switch {
+	case strings.HasPrefix(addr, "tls://"):
+		return "tls", strings.TrimPrefix(addr, "tls://")
+	case strings.HasPrefix(addr, "https://"):
+		return "https", addr
+	case strings.HasPrefix(addr, "quic://"):
+		return "quic", strings.TrimPrefix(addr, "quic://")
+	default:
+		return "", addr
+	}
+}
+
+// exchangeUpstream sends req to upstream, dispatching to the right
+// client for its scheme, and returns the reply and round-trip time.
+func exchangeUpstream(req *dns.Msg, upstream *Upstream, plainTransport string, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	scheme, target := upstreamScheme(upstream.Address)
+	switch scheme {
+	case "tls":
+		c := &dns.Client{Net: "tcp-tls", Timeout: timeout, TLSConfig: upstreamTLSConfig(target)}
+		return c.Exchange(req, target)
+	case "https":
+		return exchangeDoH(req, target, timeout)
+	case "quic":
+		return exchangeDoQ(req, target, timeout)
+	default:
+		c := &dns.Client{Net: plainTransport, Timeout: timeout}
+		return c.Exchange(req, target)
+	}
+}
+
+// upstreamTLSConfig builds the TLS config used for DoT/DoH upstreams,
+// honoring -tls-insecure for lab setups with self-signed certs.
+func upstreamTLSConfig(target string) *tls.Config {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	return &tls.Config{ServerName: host, InsecureSkipVerify: *tlsInsecure}
+}
+
+// dohClient is shared across DoH exchanges so connections are reused;
+// its Dial resolves hostnames against -bootstrap when set, since the
+// upstream may be all a client otherwise has to go on for resolving DNS.
+var dohClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: dohDialContext,
+	},
+}
+
+func dohDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if *bootstrap == "" {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	c := &dns.Client{Timeout: 5 * time.Second}
+	resp, _, err := c.Exchange(m, *bootstrap)
+	if err != nil {
+		return nil, fmt.Errorf("bootstrap resolve of %s via %s: %v", host, *bootstrap, err)
+	}
+	for _, rr := range resp.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return (&net.Dialer{}).DialContext(ctx, network, net.JoinHostPort(a.A.String(), port))
+		}
+	}
+	return nil, fmt.Errorf("bootstrap resolve of %s via %s: no A record", host, *bootstrap)
+}
+
+// defaultDoxTimeout is the fallback exchangeDoH/exchangeDoQ use for a
+// zero or negative timeout (e.g. RouteConfig.Timeout left unset), matching
+// the 2s *dns.Client falls back to internally for plain/DoT upstreams.
+const defaultDoxTimeout = 2 * time.Second
+
+func defaultTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return defaultDoxTimeout
+	}
+	return timeout
+}
+
+// exchangeDoH performs a DNS-over-HTTPS query per RFC 8484, POSTing the
+// wire-format message with content type application/dns-message.
+func exchangeDoH(req *dns.Msg, target string, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	if _, err := url.Parse(target); err != nil {
+		return nil, 0, fmt.Errorf("invalid DoH upstream %q: %v", target, err)
+	}
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout(timeout))
+	defer cancel()
+
+	start := time.Now()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+	httpReq.Header.Set("Content-Type", "application/dns-message")
+	httpReq.Header.Set("Accept", "application/dns-message")
+
+	httpResp, err := dohClient.Do(httpReq)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("DoH upstream %s returned HTTP %d", target, httpResp.StatusCode)
+	}
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, 0, err
+	}
+	return resp, time.Since(start), nil
+}
+
+// exchangeDoQ performs a DNS-over-QUIC query per RFC 9250: one
+// bidirectional stream per query, the message length-prefixed as with
+// DNS-over-TCP.
+func exchangeDoQ(req *dns.Msg, target string, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout(timeout))
+	defer cancel()
+
+	start := time.Now()
+	tlsConf := upstreamTLSConfig(target)
+	tlsConf.NextProtos = []string{"doq"}
+	conn, err := quic.DialAddr(ctx, target, tlsConf, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.CloseWithError(0, "")
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer stream.Close()
+
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	var lenPrefix [2]byte
+	binary.BigEndian.PutUint16(lenPrefix[:], uint16(len(packed)))
+	if _, err := stream.Write(append(lenPrefix[:], packed...)); err != nil {
+		return nil, 0, err
+	}
+	stream.Close() // signal end of request, per RFC 9250
+
+	if _, err := io.ReadFull(stream, lenPrefix[:]); err != nil {
+		return nil, 0, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(lenPrefix[:]))
+	if _, err := io.ReadFull(stream, body); err != nil {
+		return nil, 0, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, 0, err
+	}
+	return resp, time.Since(start), nil
+}
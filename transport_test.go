@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDefaultTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{"zero falls back to default", 0, defaultDoxTimeout},
+		{"negative falls back to default", -time.Second, defaultDoxTimeout},
+		{"positive timeout passes through", 5 * time.Second, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := defaultTimeout(tt.timeout); got != tt.want {
+				t.Errorf("defaultTimeout(%v) = %v, want %v", tt.timeout, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExchangeDoHZeroTimeoutDoesNotExpireImmediately(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		packed, err := resp.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+	defer srv.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	resp, _, err := exchangeDoH(req, srv.URL, 0)
+	if err != nil {
+		t.Fatalf("exchangeDoH with a zero route timeout returned an error: %v", err)
+	}
+	if resp == nil || resp.Id != req.Id {
+		t.Fatalf("exchangeDoH returned an unexpected response: %+v", resp)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import "github.com/miekg/dns"
+
+// trieNode is one label in a suffixTrie, keyed from the root (TLD)
+// downward so that walking toward the leaves walks toward more specific
+// names.
+type trieNode struct {
+	children map[string]*trieNode
+	value    interface{}
+	hasValue bool
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{children: make(map[string]*trieNode)}
+}
+
+// suffixTrie maps domain suffixes (e.g. "example.com.") to values and
+// answers longest-suffix-match lookups in O(labels) instead of a linear
+// scan over every registered suffix. It replaces the old
+// `for suffix, v := range m { strings.HasSuffix(...) }` pattern, which
+// picked whichever suffix the map happened to iterate first rather than
+// the most specific one.
+type suffixTrie struct {
+	root *trieNode
+}
+
+func newSuffixTrie() *suffixTrie {
+	return &suffixTrie{root: newTrieNode()}
+}
+
+// insert associates value with suffix, e.g. "example.com." or the root
+// suffix ".".
+func (t *suffixTrie) insert(suffix string, value interface{}) {
+	node := t.root
+	for _, label := range reverseLabels(suffix) {
+		child, ok := node.children[label]
+		if !ok {
+			child = newTrieNode()
+			node.children[label] = child
+		}
+		node = child
+	}
+	node.value = value
+	node.hasValue = true
+}
+
+// longestMatch returns the value registered under the longest suffix of
+// name present in the trie, along with whether any suffix matched at
+// all (including the root suffix ".").
+func (t *suffixTrie) longestMatch(name string) (interface{}, bool) {
+	node := t.root
+	best, found := node.value, node.hasValue
+	for _, label := range reverseLabels(name) {
+		child, ok := node.children[label]
+		if !ok {
+			break
+		}
+		node = child
+		if node.hasValue {
+			best, found = node.value, true
+		}
+	}
+	return best, found
+}
+
+// reverseLabels splits a domain name into its labels ordered from TLD
+// to most specific, e.g. "foo.example.com." -> ["com", "example", "foo"].
+func reverseLabels(name string) []string {
+	labels := dns.SplitDomainName(name)
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestSuffixTrieLongestMatch(t *testing.T) {
+	trie := newSuffixTrie()
+	trie.insert(".", "default")
+	trie.insert("example.com.", "example")
+	trie.insert("sub.example.com.", "sub-example")
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"example.com.", "example"},
+		{"sub.example.com.", "sub-example"},
+		{"other.sub.example.com.", "sub-example"},
+		{"example.net.", "default"},
+		{"www.example.net.", "default"},
+	}
+	for _, tt := range tests {
+		got, ok := trie.longestMatch(tt.name)
+		if !ok {
+			t.Errorf("longestMatch(%q): no match found", tt.name)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("longestMatch(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSuffixTrieNoMatchWithoutDefault(t *testing.T) {
+	trie := newSuffixTrie()
+	trie.insert("example.com.", "example")
+
+	if _, ok := trie.longestMatch("example.net."); ok {
+		t.Error("longestMatch matched a name under an unrelated suffix with no default registered")
+	}
+}
+
+// TestSuffixTrieLeadingDotSuffix guards against the leading-dot bug:
+// a suffix such as ".example.com." (as used in the package's own config
+// example) must match "example.com." itself and everything under it,
+// not get inserted one level too deep under a spurious empty label.
+func TestSuffixTrieLeadingDotSuffix(t *testing.T) {
+	trie := newSuffixTrie()
+	trie.insert(normalizeSuffix(".example.com."), "example")
+
+	for _, name := range []string{"example.com.", "sub.example.com."} {
+		if _, ok := trie.longestMatch(name); !ok {
+			t.Errorf("longestMatch(%q) = no match, want a match via the normalized leading-dot suffix", name)
+		}
+	}
+}
+
+func TestReverseLabels(t *testing.T) {
+	got := reverseLabels("foo.example.com.")
+	want := []string{"com", "example", "foo"}
+	if len(got) != len(want) {
+		t.Fatalf("reverseLabels() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("reverseLabels() = %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchConfig reloads the routing table whenever path changes on disk or
+// the process receives SIGHUP, storing the new Router into current
+// without ever leaving it empty. Reload errors are logged and the
+// previous, still-valid Router is kept in place.
+func watchConfig(path string, current *atomic.Value) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("config watch disabled, fsnotify init failed: %v", err)
+		return
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		log.Printf("config watch disabled, can't watch %s: %v", path, err)
+		return
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	reload := func() {
+		router, err := loadConfig(path)
+		if err != nil {
+			log.Printf("config reload failed, keeping previous routing table: %v", err)
+			return
+		}
+		old := current.Load().(*Router)
+		current.Store(router)
+		close(old.stop)
+		log.Printf("config reloaded from %s", path)
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Base(event.Name) != filepath.Base(path) {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					reload()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("config watcher error: %v", err)
+			case <-sighup:
+				reload()
+			}
+		}
+	}()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, path, upstream string) {
+	t.Helper()
+	body := "routes:\n  - suffix: .\n    upstreams:\n      - address: " + upstream + "\n"
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWatchConfigReloadsOnWrite exercises the atomic-swap reload path:
+// writing a new config over the watched file must publish a new Router
+// without ever leaving current holding a nil or half-built one, and must
+// close the old Router's stop channel so its health-check goroutines
+// don't leak.
+func TestWatchConfigReloadsOnWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	writeTestConfig(t, path, "127.0.0.1:8853")
+
+	initial, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	var current atomic.Value
+	current.Store(initial)
+	watchConfig(path, &current)
+
+	before := current.Load().(*Router)
+	if rt := before.route("example.com."); rt.Pool.upstreams[0].Address != "127.0.0.1:8853" {
+		t.Fatalf("initial route upstream = %s, want 127.0.0.1:8853", rt.Pool.upstreams[0].Address)
+	}
+
+	writeTestConfig(t, path, "127.0.0.1:8854")
+
+	deadline := time.Now().Add(3 * time.Second)
+	var after *Router
+	for time.Now().Before(deadline) {
+		r := current.Load().(*Router)
+		if r != before {
+			after = r
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after == nil {
+		t.Fatal("config write was not picked up within 3s")
+	}
+	if rt := after.route("example.com."); rt.Pool.upstreams[0].Address != "127.0.0.1:8854" {
+		t.Fatalf("reloaded route upstream = %s, want 127.0.0.1:8854", rt.Pool.upstreams[0].Address)
+	}
+
+	select {
+	case <-before.stop:
+	default:
+		t.Error("old Router's stop channel was not closed on reload")
+	}
+	close(after.stop)
+}